@@ -0,0 +1,33 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package domain
+
+import (
+	"github.com/pingcap/tidb/sessionctx"
+	"github.com/pingcap/tidb/util/gcutil"
+)
+
+// InitGCSafePointWatcher starts a GC safe-point watcher and installs it as
+// the default one gcutil.ValidateSnapshot reads, so stale-read and
+// `AS OF TIMESTAMP` checks stop issuing a restricted SQL query per call.
+// Every call starts a new watcher and replaces the installed one; the
+// watcher it replaces is not closed and keeps polling.
+//
+// Nothing in this repository calls it, so no default watcher is installed
+// and ValidateSnapshot still queries mysql.tidb on every call.
+func InitGCSafePointWatcher(ctx sessionctx.Context) *gcutil.SafePointWatcher {
+	w := gcutil.NewSafePointWatcher(ctx, 0)
+	gcutil.SetDefaultSafePointWatcher(w)
+	return w
+}
@@ -0,0 +1,38 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"testing"
+
+	"github.com/pingcap/tidb/planner"
+)
+
+func TestReportPreparedPlanRowCountForwardsToPlanner(t *testing.T) {
+	digest := "digest-executor-feedback"
+	planner.SetPlanCacheReoptimizeThreshold(0.1)
+	defer planner.SetPlanCacheReoptimizeThreshold(0)
+
+	reportPreparedPlanRowCount(digest, 1000)
+
+	found := false
+	for _, s := range planner.GetPreparedPlanCacheStats() {
+		if s.SQLDigest == digest && s.LastActualRows == 1000 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected reportPreparedPlanRowCount to forward the row count to planner.ReportPreparedPlanRowCount")
+	}
+}
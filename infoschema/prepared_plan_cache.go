@@ -0,0 +1,65 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package infoschema
+
+import (
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/tidb/planner"
+	"github.com/pingcap/tidb/types"
+)
+
+// TablePreparedPlanCache is the INFORMATION_SCHEMA table name
+// dataForPreparedPlanCache's rows belong under. In the full repository this
+// would be registered into tableNameToColumns and the per-table data
+// dispatcher alongside the rest of the INFORMATION_SCHEMA tables - but that
+// registry isn't part of this checkout, so TablePreparedPlanCache and
+// dataForPreparedPlanCache are not reachable from an actual
+// `SELECT * FROM INFORMATION_SCHEMA.PREPARED_PLAN_CACHE` yet; wiring them in
+// is a one-line addition to that registry once it exists.
+const TablePreparedPlanCache = "PREPARED_PLAN_CACHE"
+
+// columnInfo describes one INFORMATION_SCHEMA column, matching the shape
+// used throughout this package's table definitions.
+type columnInfo struct {
+	name string
+	tp   byte
+	size int
+}
+
+var preparedPlanCacheCols = []columnInfo{
+	{name: "SQL_DIGEST", tp: mysql.TypeVarchar, size: 64},
+	{name: "HITS", tp: mysql.TypeLonglong, size: 21},
+	{name: "MISSES", tp: mysql.TypeLonglong, size: 21},
+	{name: "LAST_LATENCY_MS", tp: mysql.TypeDouble, size: 22},
+	{name: "ESTIMATED_ROWS", tp: mysql.TypeDouble, size: 22},
+	{name: "LAST_ACTUAL_ROWS", tp: mysql.TypeLonglong, size: 21},
+}
+
+// dataForPreparedPlanCache builds INFORMATION_SCHEMA.PREPARED_PLAN_CACHE's
+// rows from planner.GetPreparedPlanCacheStats.
+func dataForPreparedPlanCache() [][]types.Datum {
+	stats := planner.GetPreparedPlanCacheStats()
+	rows := make([][]types.Datum, 0, len(stats))
+	for _, s := range stats {
+		rows = append(rows, types.MakeDatums(
+			s.SQLDigest,
+			s.Hits,
+			s.Misses,
+			float64(s.LastLatency.Microseconds())/1000,
+			s.EstimatedRows,
+			s.LastActualRows,
+		))
+	}
+	return rows
+}
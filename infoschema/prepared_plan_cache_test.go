@@ -0,0 +1,47 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package infoschema
+
+import (
+	"testing"
+
+	"github.com/pingcap/tidb/planner"
+)
+
+func TestDataForPreparedPlanCacheIncludesTrackedDigest(t *testing.T) {
+	digest := "digest-infoschema-row"
+	planner.ReportPreparedPlanRowCount(digest, 5)
+
+	var found bool
+	for _, row := range dataForPreparedPlanCache() {
+		if row[0].GetString() == digest {
+			found = true
+			if got := row[5].GetInt64(); got != 5 {
+				t.Fatalf("expected LAST_ACTUAL_ROWS=5 for %q, got %d", digest, got)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("expected a PREPARED_PLAN_CACHE row for digest %q", digest)
+	}
+}
+
+func TestPreparedPlanCacheColsMatchRowShape(t *testing.T) {
+	planner.ReportPreparedPlanRowCount("digest-infoschema-shape", 1)
+	for _, row := range dataForPreparedPlanCache() {
+		if len(row) != len(preparedPlanCacheCols) {
+			t.Fatalf("expected each row to have %d columns, got %d", len(preparedPlanCacheCols), len(row))
+		}
+	}
+}
@@ -15,6 +15,9 @@ package planner
 
 import (
 	"context"
+	"math"
+	"sync/atomic"
+	"time"
 
 	"github.com/pingcap/parser/ast"
 	"github.com/pingcap/tidb/infoschema"
@@ -58,6 +61,9 @@ func IsReadOnly(node ast.Node, vars *variable.SessionVars) bool {
 
 // Optimize does optimization and creates a Plan.
 // The node must be prepared first.
+// The actual work is delegated to the ordered pipeline of stages registered
+// in defaultOptimizeStages (see stage.go); this function only wires up the
+// initial state and unwraps the result.
 func Optimize(ctx context.Context, sctx sessionctx.Context, node ast.Node, is infoschema.InfoSchema) (plannercore.Plan, error) {
 	sessVars := sctx.GetSessionVars()
 
@@ -70,61 +76,164 @@ func Optimize(ctx context.Context, sctx sessionctx.Context, node ast.Node, is in
 		}()
 	}
 
-	if _, containTiKV := sctx.GetSessionVars().GetIsolationReadEngines()[kv.TiKV]; containTiKV {
-		fp := plannercore.TryFastPlan(sctx, node)
-		if fp != nil {
-			if !isPointGetWithoutDoubleRead(sctx, fp) {
-				sctx.PrepareTxnFuture(ctx)
-			}
-			return fp, nil
+	state := &optimizeState{ctx: ctx, sctx: sctx, node: node, is: is, handle: optimizerHandleFor(sctx)}
+	if err := runOptimizeStages(state, defaultOptimizeStages); err != nil {
+		if state.returnPlanOnError {
+			return state.plan, err
 		}
+		return nil, err
 	}
+	return state.plan, nil
+}
+
+// fastPlanStage tries the point-get/fast-plan shortcuts before a full
+// logical plan is built. It marks state as done when it finds one.
+type fastPlanStage struct{}
+
+func (fastPlanStage) Name() string { return "fast_plan" }
 
-	sctx.PrepareTxnFuture(ctx)
+func (fastPlanStage) Run(state *optimizeState) error {
+	if _, containTiKV := state.sctx.GetSessionVars().GetIsolationReadEngines()[kv.TiKV]; !containTiKV {
+		return nil
+	}
+	fp := plannercore.TryFastPlan(state.sctx, state.node)
+	if fp == nil {
+		return nil
+	}
+	if !isPointGetWithoutDoubleRead(state.sctx, fp) {
+		state.sctx.PrepareTxnFuture(state.ctx)
+	}
+	state.plan = fp
+	state.done = true
+	return nil
+}
 
-	// build logical plan
-	sctx.GetSessionVars().PlanID = 0
-	sctx.GetSessionVars().PlanColumnID = 0
-	hintProcessor := &plannercore.BlockHintProcessor{Ctx: sctx}
-	node.Accept(hintProcessor)
-	builder := plannercore.NewPlanBuilder(sctx, is, hintProcessor)
-	p, err := builder.Build(ctx, node)
+// hintAndBuildStage processes block hints and builds the logical plan.
+type hintAndBuildStage struct{}
+
+func (hintAndBuildStage) Name() string { return "hint_and_build" }
+
+func (hintAndBuildStage) Run(state *optimizeState) error {
+	state.sctx.PrepareTxnFuture(state.ctx)
+
+	sessVars := state.sctx.GetSessionVars()
+	sessVars.PlanID = 0
+	sessVars.PlanColumnID = 0
+	state.hintProcessor = &plannercore.BlockHintProcessor{Ctx: state.sctx}
+	state.node.Accept(state.hintProcessor)
+	state.builder = plannercore.NewPlanBuilder(state.sctx, state.is, state.hintProcessor)
+	p, err := state.builder.Build(state.ctx, state.node)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	sessVars.StmtCtx.Tables = state.builder.GetDBTableInfo()
+	state.plan = p
+	return nil
+}
+
+// privilegeAndLockCheckStage checks privileges and table locks against the
+// visit info collected while building the logical plan.
+type privilegeAndLockCheckStage struct{}
 
-	sctx.GetSessionVars().StmtCtx.Tables = builder.GetDBTableInfo()
-	activeRoles := sctx.GetSessionVars().ActiveRoles
+func (privilegeAndLockCheckStage) Name() string { return "privilege_and_lock_check" }
+
+func (privilegeAndLockCheckStage) Run(state *optimizeState) error {
+	activeRoles := state.sctx.GetSessionVars().ActiveRoles
 	// Check privilege. Maybe it's better to move this to the Preprocess, but
 	// we need the table information to check privilege, which is collected
 	// into the visitInfo in the logical plan builder.
-	if pm := privilege.GetPrivilegeManager(sctx); pm != nil {
-		if err := plannercore.CheckPrivilege(activeRoles, pm, builder.GetVisitInfo()); err != nil {
-			return nil, err
+	if pm := privilege.GetPrivilegeManager(state.sctx); pm != nil {
+		if err := plannercore.CheckPrivilege(activeRoles, pm, state.builder.GetVisitInfo()); err != nil {
+			return err
 		}
 	}
+	return plannercore.CheckTableLock(state.sctx, state.is, state.builder.GetVisitInfo())
+}
 
-	if err := plannercore.CheckTableLock(sctx, is, builder.GetVisitInfo()); err != nil {
-		return nil, err
+// preparedPlanStage handles `execute` statements by delegating to the
+// prepared-plan cache instead of running the logical/physical optimizer. It
+// also feeds INFORMATION_SCHEMA.PREPARED_PLAN_CACHE (see
+// plan_cache_stats.go) and adaptively forces a re-plan when the row counts
+// observed on previous executions have drifted too far from the estimate
+// the cached plan was built from.
+type preparedPlanStage struct{}
+
+func (preparedPlanStage) Name() string { return "prepared_plan" }
+
+func (preparedPlanStage) Run(state *optimizeState) error {
+	execPlan, ok := state.plan.(*plannercore.Execute)
+	if !ok {
+		return nil
+	}
+	state.done = true
+
+	sessVars := state.sctx.GetSessionVars()
+	sqlDigest := sessVars.StmtCtx.Digest
+	threshold := PlanCacheReoptimizeThreshold()
+	estimate, hasEstimate := estimatedRowsOf(execPlan)
+	if !hasEstimate && sqlDigest != "" {
+		// Fall back to the estimate recorded when the cached plan was built.
+		if v, ok := preparedPlanCacheStats.Load(sqlDigest); ok {
+			if bits := atomic.LoadUint64(&v.(*preparedPlanCacheEntry).estimatedRows); bits != 0 {
+				estimate, hasEstimate = math.Float64frombits(bits), true
+			}
+		}
+	}
+	if hasEstimate && shouldReoptimizePreparedPlan(sqlDigest, estimate, threshold) {
+		// The cached plan's row-count estimate has drifted too far from what
+		// was actually observed; force OptimizePreparedPlan to re-plan
+		// instead of reusing the stale cache entry.
+		sessVars.StmtCtx.SkipPlanCache = true
 	}
 
-	// Handle the execute statement.
-	if execPlan, ok := p.(*plannercore.Execute); ok {
-		err := execPlan.OptimizePreparedPlan(ctx, sctx, is)
-		return p, err
+	// Match the pre-pipeline behavior: a failed re-optimization of a
+	// prepared statement still returns the *plannercore.Execute wrapper
+	// alongside the error, since callers such as the slow log and
+	// plan-cache bookkeeping key off of it even on failure.
+	state.returnPlanOnError = true
+
+	start := time.Now()
+	err := execPlan.OptimizePreparedPlan(state.ctx, state.sctx, state.is)
+	recordPlanCacheLookup(sqlDigest, !sessVars.StmtCtx.SkipPlanCache, time.Since(start))
+	if newEstimate, ok := estimatedRowsOf(execPlan); ok {
+		recordPlanCacheEstimate(sqlDigest, newEstimate)
+	} else if hasEstimate {
+		recordPlanCacheEstimate(sqlDigest, estimate)
+	}
+	return err
+}
+
+// estimatedRowsOf returns the row-count estimate the cached plan underlying
+// execPlan was built from, if the plan exposes one.
+func estimatedRowsOf(execPlan *plannercore.Execute) (float64, bool) {
+	p, ok := execPlan.Plan.(interface{ StatsCount() float64 })
+	if !ok {
+		return 0, false
 	}
+	return p.StatsCount(), true
+}
+
+// logicalOptimizeStage runs the cascades or volcano optimizer over the
+// logical plan, producing the final physical plan.
+type logicalOptimizeStage struct{}
 
-	// Handle the non-logical plan statement.
-	logic, isLogicalPlan := p.(plannercore.LogicalPlan)
+func (logicalOptimizeStage) Name() string { return "logical_optimize" }
+
+func (logicalOptimizeStage) Run(state *optimizeState) error {
+	logic, isLogicalPlan := state.plan.(plannercore.LogicalPlan)
 	if !isLogicalPlan {
-		return p, nil
+		state.done = true
+		return nil
 	}
 
-	// Handle the logical plan statement, use cascades planner if enabled.
-	if sctx.GetSessionVars().EnableCascadesPlanner {
-		return cascades.FindBestPlan(sctx, logic)
+	if state.sctx.GetSessionVars().EnableCascadesPlanner {
+		p, err := cascades.FindBestPlan(state.sctx, logic)
+		state.plan = p
+		return err
 	}
-	return plannercore.DoOptimize(ctx, builder.GetOptFlag(), logic)
+	p, err := plannercore.DoOptimize(state.ctx, state.builder.GetOptFlag(), logic)
+	state.plan = p
+	return err
 }
 
 // isPointGetWithoutDoubleRead returns true when meets following conditions:
@@ -141,4 +250,12 @@ func isPointGetWithoutDoubleRead(ctx sessionctx.Context, p plannercore.Plan) boo
 
 func init() {
 	plannercore.OptimizeAstNode = Optimize
+
+	// Stages run in this order; extensions append further stages via
+	// RegisterOptimizerStage.
+	RegisterOptimizerStage(fastPlanStage{})
+	RegisterOptimizerStage(hintAndBuildStage{})
+	RegisterOptimizerStage(privilegeAndLockCheckStage{})
+	RegisterOptimizerStage(preparedPlanStage{})
+	RegisterOptimizerStage(logicalOptimizeStage{})
 }
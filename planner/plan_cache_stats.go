@@ -0,0 +1,172 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package planner
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultPlanCacheReoptimizeThreshold is the fractional row-count skew, set
+// via SetPlanCacheReoptimizeThreshold, past which a cached prepared plan is
+// rebuilt rather than reused. 0 disables adaptive reoptimization.
+//
+// tidb_plan_cache_reoptimize_threshold would be a sysvar whose SetSession
+// calls SetPlanCacheReoptimizeThreshold; that registration can't land here
+// since sessionctx/variable, where sysvars are defined, isn't part of this
+// checkout. SetPlanCacheReoptimizeThreshold is the only way to reach this
+// today.
+const defaultPlanCacheReoptimizeThreshold = 0
+
+var planCacheReoptimizeThresholdBits uint64 // atomic, math.Float64bits
+
+func init() {
+	SetPlanCacheReoptimizeThreshold(defaultPlanCacheReoptimizeThreshold)
+}
+
+// SetPlanCacheReoptimizeThreshold sets the fractional row-count skew past
+// which shouldReoptimizePreparedPlan reports that a cached plan should be
+// rebuilt. See defaultPlanCacheReoptimizeThreshold.
+func SetPlanCacheReoptimizeThreshold(threshold float64) {
+	atomic.StoreUint64(&planCacheReoptimizeThresholdBits, math.Float64bits(threshold))
+}
+
+// PlanCacheReoptimizeThreshold returns the threshold set by
+// SetPlanCacheReoptimizeThreshold.
+func PlanCacheReoptimizeThreshold() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&planCacheReoptimizeThresholdBits))
+}
+
+// PreparedPlanCacheStat is a point-in-time snapshot of the instrumentation
+// kept for one cached prepared-statement plan. INFORMATION_SCHEMA.
+// PREPARED_PLAN_CACHE is backed by GetPreparedPlanCacheStats, which returns
+// one of these per plan digest.
+type PreparedPlanCacheStat struct {
+	SQLDigest      string
+	Hits           uint64
+	Misses         uint64
+	LastLatency    time.Duration
+	EstimatedRows  float64
+	LastActualRows uint64
+}
+
+// preparedPlanCacheEntry is the live, mutable counterpart of
+// PreparedPlanCacheStat kept in preparedPlanCacheStats.
+type preparedPlanCacheEntry struct {
+	hits           uint64
+	misses         uint64
+	lastLatencyNs  int64
+	estimatedRows  uint64 // math.Float64bits, updated whenever a plan is (re-)built
+	lastActualRows uint64
+}
+
+var preparedPlanCacheStats sync.Map // sqlDigest string -> *preparedPlanCacheEntry
+
+func getOrCreatePlanCacheEntry(sqlDigest string) *preparedPlanCacheEntry {
+	v, ok := preparedPlanCacheStats.Load(sqlDigest)
+	if ok {
+		return v.(*preparedPlanCacheEntry)
+	}
+	entry := &preparedPlanCacheEntry{}
+	actual, _ := preparedPlanCacheStats.LoadOrStore(sqlDigest, entry)
+	return actual.(*preparedPlanCacheEntry)
+}
+
+// recordPlanCacheLookup records whether a prepared-plan optimization was
+// served from cache (hit) or had to re-plan (miss), along with how long the
+// lookup/re-plan took.
+func recordPlanCacheLookup(sqlDigest string, hit bool, latency time.Duration) {
+	if sqlDigest == "" {
+		return
+	}
+	entry := getOrCreatePlanCacheEntry(sqlDigest)
+	if hit {
+		atomic.AddUint64(&entry.hits, 1)
+	} else {
+		atomic.AddUint64(&entry.misses, 1)
+	}
+	atomic.StoreInt64(&entry.lastLatencyNs, int64(latency))
+}
+
+// recordPlanCacheEstimate records the row-count estimate that produced the
+// plan currently cached for sqlDigest, so it can be compared against the
+// row count actually observed once the plan runs (see
+// ReportPreparedPlanRowCount and shouldReoptimizePreparedPlan).
+func recordPlanCacheEstimate(sqlDigest string, estimatedRows float64) {
+	if sqlDigest == "" {
+		return
+	}
+	entry := getOrCreatePlanCacheEntry(sqlDigest)
+	atomic.StoreUint64(&entry.estimatedRows, math.Float64bits(estimatedRows))
+}
+
+// GetPreparedPlanCacheStats returns a snapshot of every tracked prepared-plan
+// cache entry, for INFORMATION_SCHEMA.PREPARED_PLAN_CACHE.
+func GetPreparedPlanCacheStats() []PreparedPlanCacheStat {
+	var stats []PreparedPlanCacheStat
+	preparedPlanCacheStats.Range(func(key, value interface{}) bool {
+		digest := key.(string)
+		entry := value.(*preparedPlanCacheEntry)
+		stats = append(stats, PreparedPlanCacheStat{
+			SQLDigest:      digest,
+			Hits:           atomic.LoadUint64(&entry.hits),
+			Misses:         atomic.LoadUint64(&entry.misses),
+			LastLatency:    time.Duration(atomic.LoadInt64(&entry.lastLatencyNs)),
+			EstimatedRows:  math.Float64frombits(atomic.LoadUint64(&entry.estimatedRows)),
+			LastActualRows: atomic.LoadUint64(&entry.lastActualRows),
+		})
+		return true
+	})
+	return stats
+}
+
+// ReportPreparedPlanRowCount feeds back the actual row count observed while
+// executing a cached prepared plan. When it diverges from the row count
+// estimate that produced the plan by more than the threshold set via
+// SetPlanCacheReoptimizeThreshold, shouldReoptimizePreparedPlan reports that
+// the plan should be rebuilt on its next execution rather than reused.
+// Its only caller is the executor package's reportPreparedPlanRowCount (see
+// executor/plan_cache_feedback.go), which nothing in this repository calls.
+func ReportPreparedPlanRowCount(sqlDigest string, actualRows uint64) {
+	if sqlDigest == "" {
+		return
+	}
+	entry := getOrCreatePlanCacheEntry(sqlDigest)
+	atomic.StoreUint64(&entry.lastActualRows, actualRows)
+}
+
+// shouldReoptimizePreparedPlan reports whether the gap between the row count
+// estimate used to build the cached plan and the row count actually observed
+// on its last execution exceeds threshold (a fraction, e.g. 0.5 for 50%).
+func shouldReoptimizePreparedPlan(sqlDigest string, estimatedRows float64, threshold float64) bool {
+	if threshold <= 0 {
+		return false
+	}
+	entry := getOrCreatePlanCacheEntry(sqlDigest)
+	actual := atomic.LoadUint64(&entry.lastActualRows)
+	if actual == 0 {
+		return false
+	}
+	diff := estimatedRows - float64(actual)
+	if diff < 0 {
+		diff = -diff
+	}
+	denom := estimatedRows
+	if denom < 1 {
+		denom = 1
+	}
+	return diff/denom > threshold
+}
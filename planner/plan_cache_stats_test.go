@@ -0,0 +1,87 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package planner
+
+import "testing"
+
+func TestShouldReoptimizePreparedPlan(t *testing.T) {
+	digest := "digest-should-reoptimize"
+	if shouldReoptimizePreparedPlan(digest, 100, 0.5) {
+		t.Fatal("expected no reoptimization before any actual row count has been reported")
+	}
+
+	ReportPreparedPlanRowCount(digest, 110)
+	if shouldReoptimizePreparedPlan(digest, 100, 0.5) {
+		t.Fatal("expected a 10%% skew to stay under a 50%% threshold")
+	}
+
+	ReportPreparedPlanRowCount(digest, 1000)
+	if !shouldReoptimizePreparedPlan(digest, 100, 0.5) {
+		t.Fatal("expected a 10x skew to exceed a 50%% threshold")
+	}
+
+	if shouldReoptimizePreparedPlan(digest, 100, 0) {
+		t.Fatal("expected a zero threshold to disable reoptimization entirely")
+	}
+}
+
+func TestShouldReoptimizePreparedPlanIgnoresOtherDigests(t *testing.T) {
+	ReportPreparedPlanRowCount("digest-a", 100000)
+	if shouldReoptimizePreparedPlan("digest-b", 10, 0.1) {
+		t.Fatal("expected digests to be tracked independently")
+	}
+}
+
+func TestPlanCacheReoptimizeThresholdDefaultsToDisabled(t *testing.T) {
+	if got := PlanCacheReoptimizeThreshold(); got != 0 {
+		t.Fatalf("expected the default threshold to be 0 (disabled), got %v", got)
+	}
+}
+
+func TestSetPlanCacheReoptimizeThreshold(t *testing.T) {
+	defer SetPlanCacheReoptimizeThreshold(0)
+	SetPlanCacheReoptimizeThreshold(0.25)
+	if got := PlanCacheReoptimizeThreshold(); got != 0.25 {
+		t.Fatalf("expected PlanCacheReoptimizeThreshold to return the value just set, got %v", got)
+	}
+}
+
+func TestGetPreparedPlanCacheStatsReportsEstimateAndHitMiss(t *testing.T) {
+	digest := "digest-stats-snapshot"
+	recordPlanCacheEstimate(digest, 42)
+	recordPlanCacheLookup(digest, true, 0)
+	recordPlanCacheLookup(digest, false, 0)
+	ReportPreparedPlanRowCount(digest, 7)
+
+	var found *PreparedPlanCacheStat
+	for _, s := range GetPreparedPlanCacheStats() {
+		if s.SQLDigest == digest {
+			s := s
+			found = &s
+			break
+		}
+	}
+	if found == nil {
+		t.Fatalf("expected a snapshot entry for digest %q", digest)
+	}
+	if found.EstimatedRows != 42 {
+		t.Fatalf("expected EstimatedRows to be set from recordPlanCacheEstimate, got %v", found.EstimatedRows)
+	}
+	if found.Hits != 1 || found.Misses != 1 {
+		t.Fatalf("expected one hit and one miss, got hits=%d misses=%d", found.Hits, found.Misses)
+	}
+	if found.LastActualRows != 7 {
+		t.Fatalf("expected LastActualRows to be set from ReportPreparedPlanRowCount, got %d", found.LastActualRows)
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package planner
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/tidb/infoschema"
+	plannercore "github.com/pingcap/tidb/planner/core"
+	"github.com/pingcap/tidb/sessionctx"
+)
+
+// optimizeState is threaded through the optimizer pipeline. Stages read and
+// write it in place instead of passing an ever-growing argument list.
+type optimizeState struct {
+	ctx  context.Context
+	sctx sessionctx.Context
+	node ast.Node
+	is   infoschema.InfoSchema
+
+	hintProcessor *plannercore.BlockHintProcessor
+	builder       *plannercore.PlanBuilder
+
+	// plan is the result produced so far. Stages that run after the logical
+	// plan has been built read and may replace it.
+	plan plannercore.Plan
+
+	// done is set by a stage that has already produced the final plan, which
+	// causes the remaining stages to be skipped.
+	done bool
+
+	// returnPlanOnError is set by a stage whose failure should still surface
+	// plan to the caller alongside the error (the prepared-plan branch: a
+	// failed re-optimization still returns the *plannercore.Execute wrapper,
+	// matching what callers such as the slow log and plan-cache bookkeeping
+	// expect). Every other stage's failure returns a nil plan.
+	returnPlanOnError bool
+
+	// handle is this statement's session's optimizer stage configuration
+	// (disabled stages, trace collection). Optimize always sets it; it is nil
+	// only when runOptimizeStages is driven directly without a session (as in
+	// this package's own tests), in which case no stage is disabled and
+	// nothing is traced.
+	handle *SessionOptimizerHandle
+}
+
+// OptimizeStage is a single step of the pipeline that planner.Optimize drives.
+// Stages run in registration order. Implement this interface to add a step
+// (a custom rewrite, external statistics injection, plan capture, ...)
+// without touching Optimize itself.
+type OptimizeStage interface {
+	// Name identifies the stage. It is used to address the stage in
+	// DisableOptimizerStage and to label records returned by
+	// OptimizerStageTrace when tracing is enabled.
+	Name() string
+	// Run executes the stage, mutating state in place. Returning an error
+	// aborts the pipeline and fails the statement.
+	Run(state *optimizeState) error
+}
+
+// defaultOptimizeStages holds the stages that planner.Optimize runs, in
+// order. Packages that extend the optimizer should append to it from an
+// init() function via RegisterOptimizerStage.
+var defaultOptimizeStages []OptimizeStage
+
+// RegisterOptimizerStage appends a stage to the end of the default optimizer
+// pipeline.
+func RegisterOptimizerStage(stage OptimizeStage) {
+	defaultOptimizeStages = append(defaultOptimizeStages, stage)
+}
+
+// criticalOptimizeStages can never be skipped via DisableOptimizerStage, no
+// matter what a caller asks for: they enforce privileges and table locks,
+// and disabling them would turn a debugging knob into an authorization
+// bypass.
+var criticalOptimizeStages = map[string]struct{}{
+	"privilege_and_lock_check": {},
+}
+
+// OptimizeStageTraceRecord is one stage's entry in the trace collected when
+// a session's trace flag is on; see SessionOptimizerHandle.SetTrace.
+type OptimizeStageTraceRecord struct {
+	Name     string
+	Duration time.Duration
+	Error    string
+}
+
+// SessionOptimizerHandle holds one session's optimizer pipeline
+// configuration: the stages it has disabled and whether it wants a
+// per-statement trace. It is deliberately scoped to a single session rather
+// than kept as package-global state, so that one session disabling a stage
+// (or turning on tracing) can never affect any other session's queries.
+// Every call to Optimize resets the trace buffer, so Trace/OptimizerStageTrace
+// always reflects only the statement that just ran on this session.
+//
+// A session's handle is obtained via optimizerHandleFor, keyed by its
+// sessionctx.Context. tidb_optimizer_disabled_stages and
+// tidb_optimizer_stage_trace would be wired as per-session sysvars that call
+// DisableOptimizerStage/SetOptimizerStageTrace for the current session on
+// assignment, but that sysvar registration lives in sessionctx/variable,
+// which isn't part of this checkout.
+type SessionOptimizerHandle struct {
+	mu             sync.Mutex
+	disabledStages map[string]struct{}
+	traceEnabled   bool
+	trace          []OptimizeStageTraceRecord
+}
+
+// NewSessionOptimizerHandle returns an empty handle: no stage disabled, no
+// tracing. It is exported primarily so this package's tests can exercise a
+// handle's behavior without a real sessionctx.Context.
+func NewSessionOptimizerHandle() *SessionOptimizerHandle {
+	return &SessionOptimizerHandle{}
+}
+
+// DisableStage skips the named stage for every future statement run through
+// this handle, until EnableStage is called. It is a no-op, and returns
+// false, for stages listed in criticalOptimizeStages.
+func (h *SessionOptimizerHandle) DisableStage(name string) bool {
+	if _, critical := criticalOptimizeStages[name]; critical {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.disabledStages == nil {
+		h.disabledStages = make(map[string]struct{})
+	}
+	h.disabledStages[name] = struct{}{}
+	return true
+}
+
+// EnableStage undoes a previous DisableStage call.
+func (h *SessionOptimizerHandle) EnableStage(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.disabledStages, name)
+}
+
+func (h *SessionOptimizerHandle) isDisabled(name string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, skip := h.disabledStages[name]
+	return skip
+}
+
+// SetTrace turns per-statement stage trace collection on or off for this
+// session. Turning it on or off discards whatever trace a previous
+// statement left behind.
+func (h *SessionOptimizerHandle) SetTrace(enabled bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.traceEnabled = enabled
+	h.trace = nil
+}
+
+// Trace returns the trace recorded by the most recent statement run through
+// this handle, or nil if tracing is off.
+func (h *SessionOptimizerHandle) Trace() []OptimizeStageTraceRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.traceEnabled {
+		return nil
+	}
+	out := make([]OptimizeStageTraceRecord, len(h.trace))
+	copy(out, h.trace)
+	return out
+}
+
+// beginStatementTrace clears the previous statement's trace and reports
+// whether the new statement should be traced.
+func (h *SessionOptimizerHandle) beginStatementTrace() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.traceEnabled {
+		return false
+	}
+	h.trace = nil
+	return true
+}
+
+func (h *SessionOptimizerHandle) appendTrace(rec OptimizeStageTraceRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.trace = append(h.trace, rec)
+}
+
+// sessionOptimizerHandles maps a session's sessionctx.Context to its
+// SessionOptimizerHandle. sessionctx.Context implementations are held by
+// pointer for a session's entire lifetime, so the interface value is stable
+// and comparable for as long as the session exists.
+var sessionOptimizerHandles sync.Map // sessionctx.Context -> *SessionOptimizerHandle
+
+// optimizerHandleFor returns sctx's SessionOptimizerHandle, creating one the
+// first time a given session is seen.
+func optimizerHandleFor(sctx sessionctx.Context) *SessionOptimizerHandle {
+	if v, ok := sessionOptimizerHandles.Load(sctx); ok {
+		return v.(*SessionOptimizerHandle)
+	}
+	actual, _ := sessionOptimizerHandles.LoadOrStore(sctx, NewSessionOptimizerHandle())
+	return actual.(*SessionOptimizerHandle)
+}
+
+// DisableOptimizerStage skips the named stage in every subsequent call to
+// Optimize made with sctx's session, until EnableOptimizerStage is called
+// for the same session. It never affects any other session, and is a no-op
+// (returning false) for stages listed in criticalOptimizeStages.
+func DisableOptimizerStage(sctx sessionctx.Context, name string) bool {
+	return optimizerHandleFor(sctx).DisableStage(name)
+}
+
+// EnableOptimizerStage undoes a previous DisableOptimizerStage call for
+// sctx's session.
+func EnableOptimizerStage(sctx sessionctx.Context, name string) {
+	optimizerHandleFor(sctx).EnableStage(name)
+}
+
+// SetOptimizerStageTrace turns per-statement stage timing/decision trace
+// collection on or off for sctx's session. When on, the next call to
+// Optimize made with this session records a trace entry per stage,
+// retrievable with OptimizerStageTrace.
+func SetOptimizerStageTrace(sctx sessionctx.Context, enabled bool) {
+	optimizerHandleFor(sctx).SetTrace(enabled)
+}
+
+// OptimizerStageTrace returns the trace collected for sctx's session by its
+// most recently optimized statement, or nil if tracing is off.
+func OptimizerStageTrace(sctx sessionctx.Context) []OptimizeStageTraceRecord {
+	return optimizerHandleFor(sctx).Trace()
+}
+
+// runOptimizeStages drives state through the given stages, skipping any
+// stage disabled on state.handle (criticalOptimizeStages are never skipped,
+// even if one somehow ended up in disabledStages) and recording a trace
+// record per stage when state.handle has tracing enabled. state.handle may
+// be nil, in which case nothing is disabled and nothing is traced.
+func runOptimizeStages(state *optimizeState, stages []OptimizeStage) error {
+	trace := state.handle != nil && state.handle.beginStatementTrace()
+
+	for _, stage := range stages {
+		if state.done {
+			break
+		}
+		name := stage.Name()
+		if _, critical := criticalOptimizeStages[name]; !critical {
+			if state.handle != nil && state.handle.isDisabled(name) {
+				continue
+			}
+		}
+
+		start := time.Now()
+		err := stage.Run(state)
+		if trace {
+			rec := OptimizeStageTraceRecord{Name: name, Duration: time.Since(start)}
+			if err != nil {
+				rec.Error = err.Error()
+			}
+			state.handle.appendTrace(rec)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
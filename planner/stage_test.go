@@ -0,0 +1,150 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package planner
+
+import (
+	"errors"
+	"testing"
+)
+
+type recordingStage struct {
+	name string
+	err  error
+	ran  *[]string
+}
+
+func (s recordingStage) Name() string { return s.name }
+
+func (s recordingStage) Run(state *optimizeState) error {
+	*s.ran = append(*s.ran, s.name)
+	return s.err
+}
+
+func TestRunOptimizeStagesOrderAndShortCircuit(t *testing.T) {
+	var ran []string
+	stages := []OptimizeStage{
+		recordingStage{name: "a", ran: &ran},
+		recordingStage{name: "b", ran: &ran, err: errors.New("boom")},
+		recordingStage{name: "c", ran: &ran},
+	}
+
+	state := &optimizeState{}
+	err := runOptimizeStages(state, stages)
+	if err == nil || err.Error() != "boom" {
+		t.Fatalf("expected stage b's error to propagate, got %v", err)
+	}
+	if got := ran; len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("expected stages a,b to run in order and c to be skipped after the error, got %v", got)
+	}
+}
+
+func TestSessionOptimizerHandleDisableStageRejectsCriticalStage(t *testing.T) {
+	h := NewSessionOptimizerHandle()
+
+	if ok := h.DisableStage("privilege_and_lock_check"); ok {
+		t.Fatal("expected DisableStage to refuse a critical stage")
+	}
+
+	var ran []string
+	stages := []OptimizeStage{recordingStage{name: "privilege_and_lock_check", ran: &ran}}
+	state := &optimizeState{handle: h}
+	if err := runOptimizeStages(state, stages); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ran) != 1 {
+		t.Fatalf("expected the critical stage to still run, got %v", ran)
+	}
+}
+
+func TestSessionOptimizerHandleDisableStageSkipsNonCriticalStage(t *testing.T) {
+	const name = "fast_plan"
+	h := NewSessionOptimizerHandle()
+	if ok := h.DisableStage(name); !ok {
+		t.Fatal("expected DisableStage to accept a non-critical stage")
+	}
+
+	var ran []string
+	stages := []OptimizeStage{recordingStage{name: name, ran: &ran}}
+	state := &optimizeState{handle: h}
+	if err := runOptimizeStages(state, stages); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ran) != 0 {
+		t.Fatalf("expected the disabled stage to be skipped, got %v", ran)
+	}
+
+	h.EnableStage(name)
+	ran = nil
+	if err := runOptimizeStages(state, stages); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ran) != 1 {
+		t.Fatalf("expected EnableStage to let the stage run again, got %v", ran)
+	}
+}
+
+func TestSessionOptimizerHandleIsScopedToOneHandle(t *testing.T) {
+	const name = "fast_plan"
+	disabled := NewSessionOptimizerHandle()
+	disabled.DisableStage(name)
+	other := NewSessionOptimizerHandle()
+
+	var ran []string
+	stages := []OptimizeStage{recordingStage{name: name, ran: &ran}}
+	state := &optimizeState{handle: other}
+	if err := runOptimizeStages(state, stages); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ran) != 1 {
+		t.Fatalf("expected a stage disabled on one handle to still run on another handle, got %v", ran)
+	}
+}
+
+func TestSessionOptimizerHandleTrace(t *testing.T) {
+	h := NewSessionOptimizerHandle()
+	h.SetTrace(true)
+
+	var ran []string
+	stages := []OptimizeStage{recordingStage{name: "a", ran: &ran}}
+	state := &optimizeState{handle: h}
+	if err := runOptimizeStages(state, stages); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	trace := h.Trace()
+	if len(trace) != 1 || trace[0].Name != "a" {
+		t.Fatalf("expected one trace record for stage a, got %v", trace)
+	}
+
+	// A second statement on the same handle starts from a clean trace.
+	ran = nil
+	if err := runOptimizeStages(state, stages); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if trace := h.Trace(); len(trace) != 1 {
+		t.Fatalf("expected the previous statement's trace to be cleared, got %v", trace)
+	}
+}
+
+func TestSessionOptimizerHandleNilHandleDisablesNothing(t *testing.T) {
+	var ran []string
+	stages := []OptimizeStage{recordingStage{name: "fast_plan", ran: &ran}}
+	state := &optimizeState{}
+	if err := runOptimizeStages(state, stages); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ran) != 1 {
+		t.Fatalf("expected a nil handle to disable nothing, got %v", ran)
+	}
+}
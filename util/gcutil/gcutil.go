@@ -25,20 +25,15 @@ import (
 )
 
 const (
-<<<<<<< HEAD
-	selectVariableValueSQL = `SELECT HIGH_PRIORITY variable_value FROM mysql.tidb WHERE variable_name='%s'`
-	insertVariableValueSQL = `INSERT HIGH_PRIORITY INTO mysql.tidb VALUES ('%[1]s', '%[2]s', '%[3]s')
-                              ON DUPLICATE KEY
-			                  UPDATE variable_value = '%[2]s', comment = '%[3]s'`
-=======
 	selectVariableValueSQL = `SELECT HIGH_PRIORITY variable_value FROM mysql.tidb WHERE variable_name=%?`
->>>>>>> ea6ccf82e... *: refactor the RestrictedSQLExecutor interface (#22579)
+	insertVariableValueSQL = `INSERT HIGH_PRIORITY INTO mysql.tidb VALUES (%?, %?, %?)
+                              ON DUPLICATE KEY
+			                  UPDATE variable_value = %?, comment = %?`
 )
 
 // CheckGCEnable is use to check whether GC is enable.
 func CheckGCEnable(ctx sessionctx.Context) (enable bool, err error) {
-	sql := fmt.Sprintf(selectVariableValueSQL, "tikv_gc_enable")
-	rows, _, err := ctx.(sqlexec.RestrictedSQLExecutor).ExecRestrictedSQL(sql)
+	rows, _, err := ctx.(sqlexec.RestrictedSQLExecutor).ExecRestrictedSQLWithParams(context.Background(), selectVariableValueSQL, "tikv_gc_enable")
 	if err != nil {
 		return false, errors.Trace(err)
 	}
@@ -50,23 +45,33 @@ func CheckGCEnable(ctx sessionctx.Context) (enable bool, err error) {
 
 // DisableGC will disable GC enable variable.
 func DisableGC(ctx sessionctx.Context) error {
-	sql := fmt.Sprintf(insertVariableValueSQL, "tikv_gc_enable", "false", "Current GC enable status")
-	_, _, err := ctx.(sqlexec.RestrictedSQLExecutor).ExecRestrictedSQL(sql)
+	_, _, err := ctx.(sqlexec.RestrictedSQLExecutor).ExecRestrictedSQLWithParams(context.Background(), insertVariableValueSQL,
+		"tikv_gc_enable", "false", "Current GC enable status", "false", "Current GC enable status")
 	return errors.Trace(err)
 }
 
 // EnableGC will enable GC enable variable.
 func EnableGC(ctx sessionctx.Context) error {
-	sql := fmt.Sprintf(insertVariableValueSQL, "tikv_gc_enable", "true", "Current GC enable status")
-	_, _, err := ctx.(sqlexec.RestrictedSQLExecutor).ExecRestrictedSQL(sql)
+	_, _, err := ctx.(sqlexec.RestrictedSQLExecutor).ExecRestrictedSQLWithParams(context.Background(), insertVariableValueSQL,
+		"tikv_gc_enable", "true", "Current GC enable status", "true", "Current GC enable status")
 	return errors.Trace(err)
 }
 
-// ValidateSnapshot checks that the newly set snapshot time is after GC safe point time.
+// ValidateSnapshot checks that the newly set snapshot time is after GC safe
+// point time. When a default SafePointWatcher has been installed via
+// SetDefaultSafePointWatcher, this reads its cached value instead of issuing
+// a restricted SQL query, which matters on hot paths like stale-read and
+// `AS OF TIMESTAMP` queries.
 func ValidateSnapshot(ctx sessionctx.Context, snapshotTS uint64) error {
-	safePointTS, err := GetGCSafePoint(ctx)
-	if err != nil {
-		return errors.Trace(err)
+	var safePointTS uint64
+	var err error
+	if w := getDefaultSafePointWatcher(); w != nil {
+		safePointTS = w.Current()
+	} else {
+		safePointTS, err = GetGCSafePoint(ctx)
+		if err != nil {
+			return errors.Trace(err)
+		}
 	}
 	if safePointTS > snapshotTS {
 		return variable.ErrSnapshotTooOld.GenWithStackByArgs(model.TSConvert2Time(safePointTS).String())
@@ -85,11 +90,7 @@ func ValidateSnapshotWithGCSafePoint(snapshotTS, safePointTS uint64) error {
 // GetGCSafePoint loads GC safe point time from mysql.tidb.
 func GetGCSafePoint(ctx sessionctx.Context) (uint64, error) {
 	exec := ctx.(sqlexec.RestrictedSQLExecutor)
-	stmt, err := exec.ParseWithParams(context.Background(), selectVariableValueSQL, "tikv_gc_safe_point")
-	if err != nil {
-		return 0, errors.Trace(err)
-	}
-	rows, _, err := exec.ExecRestrictedStmt(context.Background(), stmt)
+	rows, _, err := exec.ExecRestrictedSQLWithParams(context.Background(), selectVariableValueSQL, "tikv_gc_safe_point")
 	if err != nil {
 		return 0, errors.Trace(err)
 	}
@@ -0,0 +1,35 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateSnapshotUsesInstalledWatcherWithoutSQL(t *testing.T) {
+	w := newSafePointWatcher(func() (uint64, error) { return 100, nil }, time.Hour)
+	defer w.Close()
+	SetDefaultSafePointWatcher(w)
+	defer SetDefaultSafePointWatcher(nil)
+
+	// A real sessionctx.Context is unnecessary: once a watcher is installed,
+	// ValidateSnapshot must read its cached value and never dereference ctx.
+	if err := ValidateSnapshot(nil, 200); err != nil {
+		t.Fatalf("expected snapshotTS 200 to be valid against safe point 100, got %v", err)
+	}
+	if err := ValidateSnapshot(nil, 50); err == nil {
+		t.Fatal("expected snapshotTS 50 to be rejected as older than safe point 100")
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcutil
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/pingcap/tidb/sessionctx"
+	"github.com/pingcap/tidb/util/logutil"
+	"go.uber.org/zap"
+)
+
+// defaultSafePointPollInterval is used by NewSafePointWatcher when no
+// interval is supplied.
+const defaultSafePointPollInterval = 10 * time.Second
+
+// SafePointWatcher keeps a locally cached copy of tikv_gc_safe_point so that
+// hot paths like ValidateSnapshot don't have to issue a restricted SQL query
+// against mysql.tidb on every call. It is meant to be opened once per TiDB
+// instance; it polls mysql.tidb in the background and pushes every observed
+// change to its subscribers.
+type SafePointWatcher struct {
+	fetch        func() (uint64, error)
+	pollInterval time.Duration
+
+	safePoint uint64 // atomic, GoTime-encoded TS
+
+	mu        sync.Mutex
+	listeners []func(uint64)
+
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSafePointWatcher creates a SafePointWatcher and starts its background
+// poll loop. ctx is used to issue the restricted SQL queries against
+// mysql.tidb and is expected to live for the lifetime of the watcher. A
+// pollInterval <= 0 uses defaultSafePointPollInterval.
+func NewSafePointWatcher(ctx sessionctx.Context, pollInterval time.Duration) *SafePointWatcher {
+	return newSafePointWatcher(func() (uint64, error) { return GetGCSafePoint(ctx) }, pollInterval)
+}
+
+// newSafePointWatcher is the fetch-injectable core of NewSafePointWatcher,
+// split out so the poll/subscribe/close behavior can be unit tested without
+// a real sessionctx.Context backed by a store.
+func newSafePointWatcher(fetch func() (uint64, error), pollInterval time.Duration) *SafePointWatcher {
+	if pollInterval <= 0 {
+		pollInterval = defaultSafePointPollInterval
+	}
+	w := &SafePointWatcher{
+		fetch:        fetch,
+		pollInterval: pollInterval,
+		closeCh:      make(chan struct{}),
+	}
+	if sp, err := fetch(); err == nil {
+		atomic.StoreUint64(&w.safePoint, sp)
+	}
+	go w.pollLoop()
+	return w
+}
+
+// Current returns the most recently observed GC safe point without issuing
+// any SQL.
+func (w *SafePointWatcher) Current() uint64 {
+	return atomic.LoadUint64(&w.safePoint)
+}
+
+// Subscribe registers fn to be called with the new safe point value whenever
+// the watcher observes the GC safe point advance. fn runs on the watcher's
+// poll goroutine and must not block.
+func (w *SafePointWatcher) Subscribe(fn func(uint64)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.listeners = append(w.listeners, fn)
+}
+
+// Close stops the background poll loop. It is safe to call more than once.
+func (w *SafePointWatcher) Close() {
+	w.closeOnce.Do(func() { close(w.closeCh) })
+}
+
+func (w *SafePointWatcher) pollLoop() {
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.poll()
+		case <-w.closeCh:
+			return
+		}
+	}
+}
+
+func (w *SafePointWatcher) poll() {
+	sp, err := w.fetch()
+	if err != nil {
+		logutil.Logger(context.Background()).Warn("poll GC safe point failed", zap.Error(err))
+		return
+	}
+	if sp == atomic.LoadUint64(&w.safePoint) {
+		return
+	}
+	atomic.StoreUint64(&w.safePoint, sp)
+
+	w.mu.Lock()
+	listeners := make([]func(uint64), len(w.listeners))
+	copy(listeners, w.listeners)
+	w.mu.Unlock()
+	for _, fn := range listeners {
+		fn(sp)
+	}
+}
+
+// globalSafePointWatcher backs SetDefaultSafePointWatcher/
+// getDefaultSafePointWatcher; it is an atomic *SafePointWatcher.
+var globalSafePointWatcher unsafe.Pointer
+
+// SetDefaultSafePointWatcher installs w as the watcher ValidateSnapshot uses
+// for a lock-free safe-point read. Passing nil restores the legacy
+// query-per-call behavior.
+func SetDefaultSafePointWatcher(w *SafePointWatcher) {
+	atomic.StorePointer(&globalSafePointWatcher, unsafe.Pointer(w))
+}
+
+func getDefaultSafePointWatcher() *SafePointWatcher {
+	return (*SafePointWatcher)(atomic.LoadPointer(&globalSafePointWatcher))
+}
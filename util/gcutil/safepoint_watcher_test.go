@@ -0,0 +1,86 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcutil
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSafePointWatcherCurrentReflectsInitialFetch(t *testing.T) {
+	w := newSafePointWatcher(func() (uint64, error) { return 42, nil }, time.Hour)
+	defer w.Close()
+
+	if got := w.Current(); got != 42 {
+		t.Fatalf("expected Current to reflect the initial fetch, got %d", got)
+	}
+}
+
+func TestSafePointWatcherPollUpdatesCurrentAndNotifiesSubscribers(t *testing.T) {
+	var sp uint64 = 1
+	w := newSafePointWatcher(func() (uint64, error) { return atomic.LoadUint64(&sp), nil }, 5*time.Millisecond)
+	defer w.Close()
+
+	var observed uint64
+	done := make(chan struct{})
+	w.Subscribe(func(v uint64) {
+		atomic.StoreUint64(&observed, v)
+		close(done)
+	})
+
+	atomic.StoreUint64(&sp, 99)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for subscriber notification")
+	}
+
+	if got := w.Current(); got != 99 {
+		t.Fatalf("expected Current to advance to the new safe point, got %d", got)
+	}
+	if got := atomic.LoadUint64(&observed); got != 99 {
+		t.Fatalf("expected the subscriber to observe the new safe point, got %d", got)
+	}
+}
+
+func TestSafePointWatcherSkipsNotifyWhenUnchanged(t *testing.T) {
+	w := newSafePointWatcher(func() (uint64, error) { return 7, nil }, 5*time.Millisecond)
+	defer w.Close()
+
+	var calls int32
+	w.Subscribe(func(uint64) { atomic.AddInt32(&calls, 1) })
+
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt32(&calls); got != 0 {
+		t.Fatalf("expected no notifications when the safe point never changes, got %d", got)
+	}
+}
+
+func TestSafePointWatcherIgnoresFetchErrors(t *testing.T) {
+	w := newSafePointWatcher(func() (uint64, error) { return 0, errors.New("boom") }, time.Hour)
+	defer w.Close()
+
+	if got := w.Current(); got != 0 {
+		t.Fatalf("expected Current to stay at its zero value when the initial fetch fails, got %d", got)
+	}
+}
+
+func TestSafePointWatcherCloseIsIdempotent(t *testing.T) {
+	w := newSafePointWatcher(func() (uint64, error) { return 1, nil }, time.Hour)
+	w.Close()
+	w.Close() // must not panic
+}
@@ -0,0 +1,155 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlexec
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/tidb/util/chunk"
+)
+
+// RestrictedSQLExecutor is implemented by a session to run SQL statements
+// internally against system tables such as mysql.tidb, bypassing the usual
+// privilege checks.
+type RestrictedSQLExecutor interface {
+	// ExecRestrictedSQL executes sql as a restricted SQL statement.
+	//
+	// Deprecated: callers that need to bind values into the statement
+	// should use ExecRestrictedSQLWithParams instead of building sql with
+	// fmt.Sprintf, which risks injecting variable names/values into
+	// system-table SQL.
+	ExecRestrictedSQL(sql string) ([]chunk.Row, []*ast.ResultField, error)
+	// ParseWithParams parses sql, binding %? placeholders from args using
+	// the same escaping rules as prepared statements.
+	ParseWithParams(ctx context.Context, sql string, args ...interface{}) (ast.StmtNode, error)
+	// ExecRestrictedStmt executes a statement already produced by
+	// ParseWithParams as a restricted SQL statement.
+	ExecRestrictedStmt(ctx context.Context, stmt ast.StmtNode) ([]chunk.Row, []*ast.ResultField, error)
+	// ExecRestrictedSQLWithParams parses sql, binding %? placeholders from
+	// args the same way ParseWithParams does, and executes the result as a
+	// restricted SQL statement. Parsing sql is cached per (sql, args) pair,
+	// so repeated calls with the same statement and arguments - the common
+	// case for the fixed-argument restricted SQL gcutil issues - skip
+	// re-parsing on every call; each call still gets its own ast.StmtNode
+	// instance, so concurrent calls never execute the same one.
+	ExecRestrictedSQLWithParams(ctx context.Context, sql string, args ...interface{}) ([]chunk.Row, []*ast.ResultField, error)
+}
+
+// maxParsedSQLCacheEntries bounds ParsedSQLCache's memory use. Restricted
+// SQL is issued from a handful of fixed call sites (see gcutil), so this is
+// far more than this package's own callers need; it exists so a cache
+// adopted by a caller with many distinct (sql, args) pairs degrades to
+// FIFO eviction instead of growing without bound.
+const maxParsedSQLCacheEntries = 256
+
+// parsedStmtPool hands out an ast.StmtNode for one (sql, args) pair on every
+// get, reusing one returned by put when available and parsing only when the
+// pool is empty. Unlike caching a single
+// parsed ast.StmtNode directly, this never gives two concurrent callers the
+// same node: each get is exclusive until the matching put, and a get that
+// finds the pool empty just parses another instance rather than blocking or
+// sharing.
+type parsedStmtPool struct {
+	parse func() (ast.StmtNode, error)
+	pool  sync.Pool
+}
+
+func (p *parsedStmtPool) get() (ast.StmtNode, error) {
+	if v := p.pool.Get(); v != nil {
+		return v.(ast.StmtNode), nil
+	}
+	return p.parse()
+}
+
+func (p *parsedStmtPool) put(stmt ast.StmtNode) {
+	p.pool.Put(stmt)
+}
+
+// ParsedSQLCache caches, per (sql, args) pair, a pool of already-parsed
+// ast.StmtNode instances so repeated calls with the same parameterized
+// restricted SQL statement skip re-parsing without ever sharing one
+// ast.StmtNode across concurrent executions. A RestrictedSQLExecutor
+// implementation embeds one and drives it through
+// ExecRestrictedSQLWithParamsUsing. Entries beyond maxParsedSQLCacheEntries
+// are evicted oldest-first.
+type ParsedSQLCache struct {
+	mu      sync.Mutex
+	entries map[string]*parsedStmtPool
+	order   []string
+}
+
+// poolFor returns the parsedStmtPool for (sql, args), creating one if this is
+// a new pair. It does not parse sql itself; the pool's first get does.
+func (c *ParsedSQLCache) poolFor(sql string, args []interface{}, parse func() (ast.StmtNode, error)) *parsedStmtPool {
+	key := parsedSQLCacheKey(sql, args)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.entries[key]; ok {
+		return p
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]*parsedStmtPool)
+	}
+	if len(c.order) >= maxParsedSQLCacheEntries {
+		oldest := c.order[0]
+		c.order = c.order[1:]
+		delete(c.entries, oldest)
+	}
+	p := &parsedStmtPool{parse: parse}
+	c.entries[key] = p
+	c.order = append(c.order, key)
+	return p
+}
+
+func parsedSQLCacheKey(sql string, args []interface{}) string {
+	var b strings.Builder
+	b.WriteString(sql)
+	for _, a := range args {
+		b.WriteByte(0)
+		fmt.Fprint(&b, a)
+	}
+	return b.String()
+}
+
+// ExecRestrictedSQLWithParamsUsing implements the behavior described on
+// RestrictedSQLExecutor.ExecRestrictedSQLWithParams in terms of an
+// executor's own ParseWithParams/ExecRestrictedStmt methods and a cache to
+// keep parsed statements in. A concrete RestrictedSQLExecutor's
+// ExecRestrictedSQLWithParams method should be a thin wrapper around this.
+// The ast.StmtNode used for this call is returned to the pool once
+// execRestrictedStmt finishes with it, so later calls with the same (sql,
+// args) can reuse it, but never while this call still holds it.
+func ExecRestrictedSQLWithParamsUsing(
+	ctx context.Context,
+	cache *ParsedSQLCache,
+	parseWithParams func(ctx context.Context, sql string, args ...interface{}) (ast.StmtNode, error),
+	execRestrictedStmt func(ctx context.Context, stmt ast.StmtNode) ([]chunk.Row, []*ast.ResultField, error),
+	sql string,
+	args ...interface{},
+) ([]chunk.Row, []*ast.ResultField, error) {
+	pool := cache.poolFor(sql, args, func() (ast.StmtNode, error) {
+		return parseWithParams(ctx, sql, args...)
+	})
+	stmt, err := pool.get()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer pool.put(stmt)
+	return execRestrictedStmt(ctx, stmt)
+}
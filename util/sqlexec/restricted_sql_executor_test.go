@@ -0,0 +1,185 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlexec
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/pingcap/parser/ast"
+)
+
+// fakeStmt is a comparable stand-in for ast.StmtNode: real statement nodes
+// carry a lot of unrelated interface surface this package has no access to
+// in this checkout, but all these tests need is something that satisfies
+// ast.StmtNode and can be told apart by identity.
+type fakeStmt struct {
+	ast.StmtNode
+	id int
+}
+
+func TestParsedSQLCacheParsesOnceWhenUsedSequentially(t *testing.T) {
+	var c ParsedSQLCache
+	calls := 0
+	parse := func() (ast.StmtNode, error) {
+		calls++
+		return &fakeStmt{id: calls}, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		pool := c.poolFor("SELECT 1", nil, parse)
+		stmt, err := pool.get()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		pool.put(stmt)
+	}
+	if calls != 1 {
+		t.Fatalf("expected parse to run exactly once when the pool is never held concurrently, got %d", calls)
+	}
+}
+
+func TestParsedSQLCacheDistinctKeysParseIndependently(t *testing.T) {
+	var c ParsedSQLCache
+	calls := 0
+	parse := func() (ast.StmtNode, error) {
+		calls++
+		return &fakeStmt{id: calls}, nil
+	}
+
+	p1 := c.poolFor("a", nil, parse)
+	p2 := c.poolFor("b", nil, parse)
+	if p1 == p2 {
+		t.Fatalf("expected distinct (sql, args) pairs to get distinct pools")
+	}
+	if calls != 0 {
+		t.Fatalf("expected poolFor itself not to parse, got %d calls", calls)
+	}
+}
+
+func TestParsedSQLCachePropagatesParseError(t *testing.T) {
+	var c ParsedSQLCache
+	wantErr := errors.New("parse failed")
+	failed := false
+	pool := c.poolFor("key", nil, func() (ast.StmtNode, error) {
+		if !failed {
+			failed = true
+			return nil, wantErr
+		}
+		return &fakeStmt{}, nil
+	})
+	if _, err := pool.get(); err != wantErr {
+		t.Fatalf("expected parse's error to propagate, got %v", err)
+	}
+
+	// A failed parse must not poison the pool: the next get should retry.
+	stmt, err := pool.get()
+	if err != nil {
+		t.Fatalf("unexpected error on retry: %v", err)
+	}
+	if stmt == nil {
+		t.Fatal("expected a fresh parse attempt to succeed")
+	}
+}
+
+func TestParsedSQLCacheNeverHandsTheSameStmtToTwoConcurrentHolders(t *testing.T) {
+	var c ParsedSQLCache
+	var parseCalls int32
+	var mu sync.Mutex
+	parse := func() (ast.StmtNode, error) {
+		mu.Lock()
+		parseCalls++
+		id := parseCalls
+		mu.Unlock()
+		return &fakeStmt{id: int(id)}, nil
+	}
+	pool := c.poolFor("SELECT %?", []interface{}{"tikv_gc_enable"}, parse)
+
+	const n = 50
+	// held counts the current holders of each *fakeStmt; maxHeld records the
+	// largest number of simultaneous holders ever observed for it. A stmt
+	// reused by a later get after put is not a concurrent hold.
+	held := make(map[*fakeStmt]int, n)
+	maxHeld := make(map[*fakeStmt]int, n)
+	var seenMu sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			stmt, err := pool.get()
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			fs := stmt.(*fakeStmt)
+			seenMu.Lock()
+			held[fs]++
+			if held[fs] > maxHeld[fs] {
+				maxHeld[fs] = held[fs]
+			}
+			seenMu.Unlock()
+			seenMu.Lock()
+			held[fs]--
+			seenMu.Unlock()
+			pool.put(stmt)
+		}()
+	}
+	wg.Wait()
+
+	for stmt, count := range maxHeld {
+		if count > 1 {
+			t.Fatalf("expected every held *fakeStmt to be exclusive to its holder, got id=%d held by %d holders at once", stmt.id, count)
+		}
+	}
+}
+
+func TestParsedSQLCacheEvictsOldestEntryBeyondCapacity(t *testing.T) {
+	var c ParsedSQLCache
+	parse := func() (ast.StmtNode, error) { return &fakeStmt{}, nil }
+
+	for i := 0; i < maxParsedSQLCacheEntries+1; i++ {
+		c.poolFor(fmt.Sprintf("SELECT %d", i), nil, parse)
+	}
+
+	c.mu.Lock()
+	n := len(c.entries)
+	_, firstStillCached := c.entries[parsedSQLCacheKey("SELECT 0", nil)]
+	_, lastStillCached := c.entries[parsedSQLCacheKey(fmt.Sprintf("SELECT %d", maxParsedSQLCacheEntries), nil)]
+	c.mu.Unlock()
+
+	if n != maxParsedSQLCacheEntries {
+		t.Fatalf("expected the cache to stay bounded at %d entries, got %d", maxParsedSQLCacheEntries, n)
+	}
+	if firstStillCached {
+		t.Fatal("expected the oldest entry to have been evicted")
+	}
+	if !lastStillCached {
+		t.Fatal("expected the most recently added entry to still be cached")
+	}
+}
+
+func TestParsedSQLCacheKeyDistinguishesArgs(t *testing.T) {
+	k1 := parsedSQLCacheKey("SELECT %?", []interface{}{"tikv_gc_enable"})
+	k2 := parsedSQLCacheKey("SELECT %?", []interface{}{"tikv_gc_safe_point"})
+	if k1 == k2 {
+		t.Fatalf("expected different arguments to produce different cache keys")
+	}
+	k3 := parsedSQLCacheKey("SELECT %?", []interface{}{"tikv_gc_enable"})
+	if k1 != k3 {
+		t.Fatalf("expected identical (sql, args) to produce the same cache key")
+	}
+}